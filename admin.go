@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// configSnapshot bundles everything a connection needs to pick a listener,
+// dial a parent and classify a domain. Reloading the rc file builds a new
+// snapshot and swaps it in atomically, so in-flight connections keep using
+// the snapshot that was current when they were dialed instead of seeing a
+// half-updated config.
+type configSnapshot struct {
+	config      Config
+	parentProxy ParentPool
+	listenProxy []Proxy
+	auth        authBackend
+}
+
+var currentSnapshot atomic.Value // holds *configSnapshot
+
+// snapshot returns the config snapshot in effect for new connections.
+func snapshot() *configSnapshot {
+	return currentSnapshot.Load().(*configSnapshot)
+}
+
+// currentAuthState returns the config/auth pair connection-handling code
+// should authenticate against: the live snapshot once the admin control
+// socket has published one, or the raw globals beforehand (e.g. while
+// StartAdmin was never called because adminAddr is unset).
+func currentAuthState() (Config, authBackend) {
+	if v, ok := currentSnapshot.Load().(*configSnapshot); ok {
+		return v.config, v.auth
+	}
+	return config, auth
+}
+
+// publishSnapshot takes the current package-level config/parentProxy/
+// listenProxy/auth globals and atomically publishes them as the snapshot
+// new connections should use.
+func publishSnapshot() {
+	currentSnapshot.Store(&configSnapshot{
+		config:      config,
+		parentProxy: parentProxy,
+		listenProxy: listenProxy,
+		auth:        auth,
+	})
+}
+
+// reloadMu serializes reloads, since each one mutates the
+// config/parentProxy/listenProxy/auth globals in place before
+// publishSnapshot hands readers an immutable copy. Only reloadConfig takes
+// it; the initial parse does not.
+var reloadMu sync.Mutex
+
+// reloadConfig re-parses the rc file and publishes a new snapshot. It's
+// triggered by SIGHUP and by the admin /reload endpoint.
+//
+// parseConfig only ever adds parents (parentProxy.add) and listeners
+// (addListenProxy), so reloadConfig must reset those pools first, or every
+// reload would duplicate every "proxy =" and re-attempt to listen on
+// addresses that are already bound. Domain lists are re-read for the same
+// reason: ParseDirectFile/ParseProxyFile/ParseRejectFile may have changed.
+func reloadConfig() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	rc := config.RcFile
+	oldParentProxy := parentProxy
+	oldListenProxy := listenProxy
+	oldAuth := auth
+
+	parentProxy = new(backupParentPool)
+	listenProxy = nil
+	auth = noneAuthBackend{}
+
+	var override Config
+	parseConfig(rc, &override)
+
+	initDomainListMetered(config.DirectFile, "direct", domainTypeDirect)
+	initDomainListMetered(config.ProxyFile, "proxy", domainTypeProxy)
+	initDomainListMetered(config.RejectFile, "reject", domainTypeReject)
+
+	if config.LoadBalance == loadBalanceLatency {
+		parentProxy = buildLatencyParentPool(parentProxy)
+	}
+
+	listenProxy = reconcileListeners(oldListenProxy, listenProxy)
+
+	publishSnapshot()
+
+	if lp, ok := oldParentProxy.(*latencyParentPool); ok {
+		lp.stop()
+	}
+	if fb, ok := oldAuth.(*basicFileAuthBackend); ok {
+		fb.stop()
+	}
+	return nil
+}
+
+// reconcileListeners merges freshly parsed listeners into the ones already
+// bound and serving from the previous config. A listener whose genConfig
+// (its listen address and scheme) didn't change keeps the old, already
+// listening Proxy instead of a cosmetic new one that nothing has Serve'd,
+// so an unrelated rc change doesn't interrupt sockets. Listeners that
+// disappeared from the new config are closed; genuinely new ones are
+// started.
+func reconcileListeners(old, new_ []Proxy) []Proxy {
+	oldByKey := make(map[string]Proxy, len(old))
+	for _, p := range old {
+		oldByKey[p.genConfig()] = p
+	}
+
+	merged := make([]Proxy, len(new_))
+	seen := make(map[string]bool, len(new_))
+	for i, p := range new_ {
+		key := p.genConfig()
+		seen[key] = true
+		if existing, ok := oldByKey[key]; ok {
+			merged[i] = existing
+			continue
+		}
+		merged[i] = p
+		startListener(p)
+	}
+
+	for key, p := range oldByKey {
+		if !seen[key] {
+			closeListener(p)
+		}
+	}
+	return merged
+}
+
+// startListener starts serving p if it implements the "Serve()" method
+// every concrete listener type (httpProxy, etc.) is expected to.
+// It's a type assertion rather than an addition to the Proxy interface so
+// reconcileListeners keeps working against listener types that predate it.
+func startListener(p Proxy) {
+	if s, ok := p.(interface{ Serve() }); ok {
+		go s.Serve()
+	}
+}
+
+// closeListener closes p's underlying socket if it implements io.Closer,
+// so a listener removed by a reload doesn't keep its port bound forever.
+func closeListener(p Proxy) {
+	if c, ok := p.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			errl.Println("closing listener removed by reload:", err)
+		}
+	}
+}
+
+// handleSIGHUP re-parses the rc file on SIGHUP, allowing config changes to
+// take effect without restarting MEOW or dropping existing connections.
+func handleSIGHUP() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := reloadConfig(); err != nil {
+			errl.Println("reload on SIGHUP:", err)
+		}
+	}
+}
+
+// StartAdmin starts the admin HTTP listener if adminAddr is configured. It
+// exposes /reload, /status, /proxies and /pac for operators and monitoring,
+// similar to frp's admin API.
+func StartAdmin(adminAddr string) {
+	if adminAddr == "" {
+		return
+	}
+
+	publishSnapshot()
+	go handleSIGHUP()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reload", adminReload)
+	mux.HandleFunc("/status", adminStatus)
+	mux.HandleFunc("/proxies", adminProxies)
+	mux.HandleFunc("/pac", adminPAC)
+
+	go func() {
+		if err := http.ListenAndServe(adminAddr, mux); err != nil {
+			errl.Println("admin listener:", err)
+		}
+	}()
+}
+
+func adminReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "reload requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadConfig(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	s := snapshot()
+	status := map[string]interface{}{
+		"version":     version,
+		"loadBalance": s.config.LoadBalance,
+		"listen":      len(s.listenProxy),
+	}
+	if lp, ok := s.parentProxy.(*latencyParentPool); ok {
+		status["parentRTT"] = lp.rtts()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func adminProxies(w http.ResponseWriter, r *http.Request) {
+	s := snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	names := make([]string, 0, len(s.listenProxy))
+	for _, p := range s.listenProxy {
+		names = append(names, p.genConfig())
+	}
+	json.NewEncoder(w).Encode(names)
+}
+
+func adminPAC(w http.ResponseWriter, r *http.Request) {
+	s := snapshot()
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	for _, p := range s.listenProxy {
+		if hp, ok := p.(*httpProxy); ok {
+			fmt.Fprintln(w, hp.addrInPAC)
+		}
+	}
+}
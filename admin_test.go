@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+// fakeListener is a minimal stand-in for httpProxy et al., implementing
+// just enough of Proxy plus the optional Serve()/io.Closer hooks
+// reconcileListeners looks for.
+type fakeListener struct {
+	addr   string
+	served bool
+	closed bool
+}
+
+func (f *fakeListener) genConfig() string { return "http://" + f.addr }
+func (f *fakeListener) Serve()            { f.served = true }
+func (f *fakeListener) Close() error      { f.closed = true; return nil }
+
+func TestReconcileListenersKeepsUnchangedListener(t *testing.T) {
+	old := &fakeListener{addr: "127.0.0.1:8080"}
+	fresh := &fakeListener{addr: "127.0.0.1:8080"}
+
+	merged := reconcileListeners([]Proxy{old}, []Proxy{fresh})
+
+	if len(merged) != 1 || merged[0] != Proxy(old) {
+		t.Error("reconcileListeners should keep the already-bound listener for an unchanged address")
+	}
+	if fresh.served {
+		t.Error("the discarded duplicate listener should never be started")
+	}
+	if old.closed {
+		t.Error("a listener still present in the new config should not be closed")
+	}
+}
+
+func TestReconcileListenersStartsAddedAndClosesRemoved(t *testing.T) {
+	removed := &fakeListener{addr: "127.0.0.1:8080"}
+	added := &fakeListener{addr: "127.0.0.1:9090"}
+
+	merged := reconcileListeners([]Proxy{removed}, []Proxy{added})
+
+	if len(merged) != 1 || merged[0] != Proxy(added) {
+		t.Error("reconcileListeners should include the newly added listener")
+	}
+	if !added.served {
+		t.Error("a genuinely new listener should be started")
+	}
+	if !removed.closed {
+		t.Error("a listener no longer in the new config should be closed")
+	}
+}
+
+func TestStopOldLatencyPoolOnReload(t *testing.T) {
+	lp := newLatencyParentPool()
+	ph := &parentHealth{parent: fakeParent{server: "127.0.0.1:1"}}
+	lp.parent = append(lp.parent, ph)
+
+	var oldParentProxy ParentPool = lp
+	if p, ok := oldParentProxy.(*latencyParentPool); ok {
+		p.stop()
+	}
+
+	select {
+	case <-lp.stopCh:
+	default:
+		t.Error("stopping the old *latencyParentPool should close its stopCh")
+	}
+}
+
+func TestStopOldBasicFileAuthBackendOnReload(t *testing.T) {
+	fb := &basicFileAuthBackend{stopCh: make(chan struct{})}
+
+	var oldAuth authBackend = fb
+	if b, ok := oldAuth.(*basicFileAuthBackend); ok {
+		b.stop()
+	}
+
+	select {
+	case <-fb.stopCh:
+	default:
+		t.Error("stopping the old *basicFileAuthBackend should close its stopCh")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Put actual authentication related config parsing in auth.go, so config.go
+// doesn't need to know the details of authentication implementation.
+
+// userCredential is one entry of an authBackend's credential map: the
+// password to check plus the optional per-user port restriction carried by
+// the "user:passwd:[port]" file format (UserPasswdFile). port is "" when the
+// line didn't specify one, meaning the user isn't restricted to a port.
+type userCredential struct {
+	passwd string
+	port   string
+}
+
+// authBackend supplies the user credential map used to authenticate
+// clients. basicfile backends reload the file on change, static and none
+// backends never change after creation.
+type authBackend interface {
+	credentials() map[string]userCredential
+}
+
+var auth authBackend = noneAuthBackend{}
+
+// authenticate reports whether user/passwd are valid credentials. It reads
+// through currentAuthState so a reload swaps which config/backend it
+// checks against without racing the connection that's mid-authentication.
+// It checks the legacy single userPasswd option first, then falls back to
+// the configured auth backend (static, basicfile, or none), comparing via
+// checkPasswd so bcrypt-hashed entries work the same as plaintext ones.
+// This is the entry point the HTTP auth-challenge code should call once per
+// request before letting it through.
+func authenticate(user, passwd string) bool {
+	cfg, backend := currentAuthState()
+
+	if cfg.UserPasswd != "" {
+		arr := strings.SplitN(cfg.UserPasswd, ":", 2)
+		if user == arr[0] && checkPasswd(passwd, arr[1]) {
+			return true
+		}
+	}
+
+	cred := backend.credentials()
+	stored, ok := cred[user]
+	return ok && checkPasswd(passwd, stored.passwd)
+}
+
+// allowedPort reports the port user is restricted to, per a "[port]" field
+// on their UserPasswdFile line, and whether such a restriction exists at
+// all. Listener code should call this after authenticate succeeds and
+// reject the connection if restricted and it arrived on a different port.
+func allowedPort(user string) (port string, restricted bool) {
+	_, backend := currentAuthState()
+	cred, ok := backend.credentials()[user]
+	if !ok || cred.port == "" {
+		return "", false
+	}
+	return cred.port, true
+}
+
+// isBcryptHash reports whether passwd is a bcrypt hash rather than a
+// plaintext password, recognized by its standard $2a$/$2b$/$2y$ prefix.
+func isBcryptHash(passwd string) bool {
+	return strings.HasPrefix(passwd, "$2a$") ||
+		strings.HasPrefix(passwd, "$2b$") ||
+		strings.HasPrefix(passwd, "$2y$")
+}
+
+// checkPasswd compares passwd against stored, using bcrypt if stored looks
+// like a bcrypt hash and a plain comparison otherwise.
+func checkPasswd(passwd, stored string) bool {
+	if isBcryptHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(passwd)) == nil
+	}
+	return passwd == stored
+}
+
+// parseUserPasswdLines parses "user:passwd:[port]" lines, one per line, as
+// used by both userPasswdFile and the basicfile auth backend. The port
+// field is optional and, when present, restricts that user to connecting
+// on it (see allowedPort).
+func parseUserPasswdLines(r *bufio.Scanner) map[string]userCredential {
+	cred := make(map[string]userCredential)
+	for r.Scan() {
+		line := strings.TrimSpace(r.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		arr := strings.SplitN(line, ":", 3)
+		if len(arr) < 2 || arr[0] == "" || arr[1] == "" {
+			Fatal("userPasswdFile syntax wrong, should be in the form of user:passwd:[port]")
+		}
+		c := userCredential{passwd: arr[1]}
+		if len(arr) == 3 && arr[2] != "" {
+			c.port = arr[2]
+		}
+		cred[arr[0]] = c
+	}
+	return cred
+}
+
+// staticAuthBackend holds a fixed credential map parsed once from the
+// authBackend config option, e.g. authBackend = static://user:pass.
+type staticAuthBackend struct {
+	cred map[string]userCredential
+}
+
+func newStaticAuthBackend(val string) *staticAuthBackend {
+	if !isUserPasswdValid(val) {
+		Fatal("authBackend static:// syntax wrong, should be in the form of user:passwd")
+	}
+	arr := strings.SplitN(val, ":", 2)
+	return &staticAuthBackend{cred: map[string]userCredential{arr[0]: {passwd: arr[1]}}}
+}
+
+func (s *staticAuthBackend) credentials() map[string]userCredential {
+	return s.cred
+}
+
+// noneAuthBackend disables authentication entirely.
+type noneAuthBackend struct{}
+
+func (noneAuthBackend) credentials() map[string]userCredential {
+	return nil
+}
+
+// basicFileAuthBackend loads user:passwd pairs (optionally bcrypt-hashed)
+// from a file, and re-reads it whenever its mtime changes, swapping the
+// credential map atomically behind a RWMutex.
+type basicFileAuthBackend struct {
+	path   string
+	reload time.Duration
+	stopCh chan struct{}
+
+	mu      sync.RWMutex
+	cred    map[string]userCredential
+	modTime time.Time
+}
+
+func newBasicFileAuthBackend(path string, reload time.Duration) *basicFileAuthBackend {
+	if err := isFileExists(path); err != nil {
+		Fatal("authBackend basicfile:", err)
+	}
+	b := &basicFileAuthBackend{path: path, reload: reload, stopCh: make(chan struct{})}
+	b.load()
+	if reload > 0 {
+		go b.watch()
+	}
+	return b
+}
+
+// stop terminates the watch goroutine started by newBasicFileAuthBackend,
+// so a discarded basicFileAuthBackend (e.g. the one a config reload just
+// replaced) doesn't keep polling a file no one queries credentials from
+// anymore. It's a no-op if watch was never started.
+func (b *basicFileAuthBackend) stop() {
+	close(b.stopCh)
+}
+
+func (b *basicFileAuthBackend) load() {
+	fi, err := os.Stat(b.path)
+	if err != nil {
+		Fatal("authBackend basicfile:", err)
+	}
+
+	f, err := os.Open(b.path)
+	if err != nil {
+		Fatal("authBackend basicfile:", err)
+	}
+	defer f.Close()
+
+	cred := parseUserPasswdLines(bufio.NewScanner(f))
+
+	b.mu.Lock()
+	b.cred = cred
+	b.modTime = fi.ModTime()
+	b.mu.Unlock()
+}
+
+// watch polls the file every b.reload and reloads it on mtime change. It
+// returns as soon as b.stop is called, so a backend discarded on reload
+// doesn't leak a goroutine.
+func (b *basicFileAuthBackend) watch() {
+	ticker := time.NewTicker(b.reload)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(b.path)
+		if err != nil {
+			errl.Println("authBackend basicfile:", err)
+			continue
+		}
+		b.mu.RLock()
+		changed := !fi.ModTime().Equal(b.modTime)
+		b.mu.RUnlock()
+		if changed {
+			b.load()
+		}
+	}
+}
+
+func (b *basicFileAuthBackend) credentials() map[string]userCredential {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.cred
+}
+
+// authParser provides functions to parse different authBackend schemes.
+type authParser struct{}
+
+func (authParser) AuthStatic(val string) {
+	auth = newStaticAuthBackend(val)
+}
+
+func (authParser) AuthNone(val string) {
+	auth = noneAuthBackend{}
+}
+
+// AuthBasicfile parses basicfile:///path/to/file?reload=30s
+func (authParser) AuthBasicfile(val string) {
+	path := val
+	reload := 30 * time.Second
+
+	if idx := strings.Index(val, "?"); idx != -1 {
+		path = val[:idx]
+		query := val[idx+1:]
+		for _, kv := range strings.Split(query, "&") {
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if parts[0] == "reload" {
+				reload = parseDuration(parts[1], "authBackend basicfile reload")
+			}
+		}
+	}
+
+	auth = newBasicFileAuthBackend(path, reload)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestIsBcryptHash(t *testing.T) {
+	cases := []struct {
+		passwd string
+		want   bool
+	}{
+		{"$2a$10$abcdefghijklmnopqrstuv", true},
+		{"$2b$12$abcdefghijklmnopqrstuv", true},
+		{"$2y$10$abcdefghijklmnopqrstuv", true},
+		{"plaintext", false},
+		{"", false},
+	}
+	for _, c := range cases {
+		if got := isBcryptHash(c.passwd); got != c.want {
+			t.Errorf("isBcryptHash(%q) = %v, want %v", c.passwd, got, c.want)
+		}
+	}
+}
+
+func TestCheckPasswdPlaintext(t *testing.T) {
+	if !checkPasswd("secret", "secret") {
+		t.Error("expected plaintext match to succeed")
+	}
+	if checkPasswd("wrong", "secret") {
+		t.Error("expected plaintext mismatch to fail")
+	}
+}
+
+func TestParseUserPasswdLinesWithoutPort(t *testing.T) {
+	cred := parseUserPasswdLines(bufio.NewScanner(strings.NewReader("alice:secret\n")))
+	c, ok := cred["alice"]
+	if !ok || c.passwd != "secret" || c.port != "" {
+		t.Errorf("cred[alice] = %+v, ok=%v, want {passwd:secret port:\"\"}, true", c, ok)
+	}
+}
+
+func TestParseUserPasswdLinesWithPort(t *testing.T) {
+	cred := parseUserPasswdLines(bufio.NewScanner(strings.NewReader("alice:secret:8080\n")))
+	c, ok := cred["alice"]
+	if !ok || c.passwd != "secret" || c.port != "8080" {
+		t.Errorf("cred[alice] = %+v, ok=%v, want {passwd:secret port:8080}, true", c, ok)
+	}
+}
+
+func TestAllowedPortReflectsCredentialPort(t *testing.T) {
+	old := auth
+	defer func() { auth = old }()
+
+	auth = &staticAuthBackend{cred: map[string]userCredential{
+		"alice": {passwd: "secret", port: "8080"},
+		"bob":   {passwd: "secret"},
+	}}
+
+	if port, restricted := allowedPort("alice"); !restricted || port != "8080" {
+		t.Errorf("allowedPort(alice) = %q, %v, want 8080, true", port, restricted)
+	}
+	if _, restricted := allowedPort("bob"); restricted {
+		t.Error("allowedPort(bob) should report no restriction")
+	}
+	if _, restricted := allowedPort("nobody"); restricted {
+		t.Error("allowedPort(nobody) should report no restriction")
+	}
+}
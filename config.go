@@ -45,6 +45,15 @@ type Config struct {
 	DialTimeout time.Duration
 	ReadTimeout time.Duration
 
+	// control plane
+	AdminAddr   string // address for the admin HTTP listener, enables live reload
+	MetricsAddr string // address for the Prometheus metrics HTTP listener
+
+	// loadBalanceLatency probing
+	LatencyProbeInterval time.Duration
+	LatencyProbeTimeout  time.Duration
+	LatencyFailThreshold int
+
 	Core int
 
 	HttpErrorCode int
@@ -80,6 +89,10 @@ func initConfig(rcFile string) {
 	config.JudgeByIP = true
 
 	config.AuthTimeout = 2 * time.Hour
+
+	config.LatencyProbeInterval = 30 * time.Second
+	config.LatencyProbeTimeout = 5 * time.Second
+	config.LatencyFailThreshold = 3
 }
 
 // Whether command line options specifies listen addr
@@ -109,9 +122,9 @@ func parseCmdLineConfig() *Config {
 		Fatal("fail to get config file:", err)
 	}
 	initConfig(c.RcFile)
-	initDomainList(config.DirectFile, domainTypeDirect)
-	initDomainList(config.ProxyFile, domainTypeProxy)
-	initDomainList(config.RejectFile, domainTypeReject)
+	initDomainListMetered(config.DirectFile, "direct", domainTypeDirect)
+	initDomainListMetered(config.ProxyFile, "proxy", domainTypeProxy)
+	initDomainListMetered(config.RejectFile, "reject", domainTypeReject)
 
 	if listenAddr != "" {
 		configParser{}.ParseListen(listenAddr)
@@ -263,6 +276,34 @@ func (pp proxyParser) ProxySs(val string) {
 	parentProxy.add(parent)
 }
 
+// parse trojan proxy: trojan://password@host:port?sni=example.com&skip-verify=false
+func (pp proxyParser) ProxyTrojan(val string) {
+	idx := strings.LastIndex(val, "@")
+	if idx == -1 {
+		Fatal("trojan parent proxy requires password:", val)
+	}
+	password := val[:idx]
+	server := val[idx+1:]
+
+	var query string
+	if i := strings.Index(server, "?"); i != -1 {
+		query = server[i+1:]
+		server = server[:i]
+	}
+
+	if password == "" {
+		Fatal("trojan parent proxy requires non-empty password")
+	}
+	if err := checkServerAddr(server); err != nil {
+		Fatal("parent trojan server", err)
+	}
+
+	parent := newTrojanParent(server)
+	parent.initAuth(password)
+	parent.initTLS(query)
+	parentProxy.add(parent)
+}
+
 // listenParser provides functions to parse different types of listen addresses
 type listenParser struct{}
 
@@ -271,21 +312,40 @@ func (lp listenParser) ListenHttp(val string, proto string) {
 		return
 	}
 
-	arr := strings.Fields(val)
-	if len(arr) > 2 {
-		Fatal("too many fields in listen =", proto, val)
-	}
-
-	var addr, addrInPAC string
-	addr = arr[0]
-	if len(arr) == 2 {
-		addrInPAC = arr[1]
+	var addr, addrInPAC, proxyProtocol string
+	for _, f := range strings.Fields(val) {
+		if rest, ok := cutPrefix(f, "proxyProtocol="); ok {
+			proxyProtocol = rest
+		} else if addr == "" {
+			addr = f
+		} else if addrInPAC == "" {
+			addrInPAC = f
+		} else {
+			Fatal("too many fields in listen =", proto, val)
+		}
 	}
 
 	if err := checkServerAddr(addr); err != nil {
 		Fatal("listen", proto, "server", err)
 	}
+	if proxyProtocol != "" && proxyProtocol != "v1" && proxyProtocol != "v2" {
+		Fatal("proxyProtocol should be v1 or v2:", proxyProtocol)
+	}
 	addListenProxy(newHttpProxy(addr, addrInPAC, proto))
+	if proxyProtocol != "" {
+		// Accept must call acceptConn(conn, addr, proto) so the PROXY header
+		// registered here for addr actually gets decoded; see proxyproto.go.
+		registerProxyProtocol(addr, proxyProtocol)
+	}
+}
+
+// cutPrefix splits s into the remainder after prefix if s starts with
+// prefix, mirroring strings.CutPrefix for build environments predating it.
+func cutPrefix(s, prefix string) (string, bool) {
+	if strings.HasPrefix(s, prefix) {
+		return s[len(prefix):], true
+	}
+	return s, false
 }
 
 // configParser provides functions to parse options in config file.
@@ -348,6 +408,24 @@ func (p configParser) ParseLogFile(val string) {
 	config.LogFile = expandTilde(val)
 }
 
+// ParseAdminAddr enables the admin control socket on val, serving /reload,
+// /status, /proxies and /pac. See admin.go.
+func (p configParser) ParseAdminAddr(val string) {
+	if err := checkServerAddr(val); err != nil {
+		Fatal("adminAddr", err)
+	}
+	config.AdminAddr = val
+}
+
+// ParseMetricsAddr enables the Prometheus metrics endpoint on val. See
+// metrics.go.
+func (p configParser) ParseMetricsAddr(val string) {
+	if err := checkServerAddr(val); err != nil {
+		Fatal("metricsAddr", err)
+	}
+	config.MetricsAddr = val
+}
+
 func (p configParser) ParseAddrInPAC(val string) {
 	configNeedUpgrade = true
 	arr := strings.Split(val, ",")
@@ -434,6 +512,18 @@ func (p configParser) ParseLoadBalance(val string) {
 	}
 }
 
+func (p configParser) ParseLatencyProbeInterval(val string) {
+	config.LatencyProbeInterval = parseDuration(val, "latencyProbeInterval")
+}
+
+func (p configParser) ParseLatencyProbeTimeout(val string) {
+	config.LatencyProbeTimeout = parseDuration(val, "latencyProbeTimeout")
+}
+
+func (p configParser) ParseLatencyFailThreshold(val string) {
+	config.LatencyFailThreshold = parseInt(val, "latencyFailThreshold")
+}
+
 func (p configParser) ParseDirectFile(val string) {
 	config.DirectFile = expandTilde(val)
 	if err := isFileExists(config.DirectFile); err != nil {
@@ -524,12 +614,46 @@ func (p configParser) ParseUserPasswd(val string) {
 	}
 }
 
+// ParseUserPasswdFile accepts a file of user:passwd:[port] lines, one per
+// line. passwd may be plaintext or a bcrypt hash (auto-detected by its
+// $2a$/$2b$/$2y$ prefix), checked via checkPasswd. The optional port
+// restricts that user to connecting on it, checked via allowedPort.
 func (p configParser) ParseUserPasswdFile(val string) {
 	err := isFileExists(val)
 	if err != nil {
 		Fatal("userPasswdFile:", err)
 	}
 	config.UserPasswdFile = val
+	// userPasswdFile is a one-shot load; authBackend = basicfile://...
+	// is the reloadable equivalent of this same file format.
+	auth = newBasicFileAuthBackend(val, 0)
+}
+
+// ParseAuthBackend parses authBackend = static://user:pass |
+// basicfile:///path?reload=30s | none, dispatching to authParser the same
+// way ParseProxy dispatches to proxyParser.
+func (p configParser) ParseAuthBackend(val string) {
+	if val == "none" {
+		authParser{}.AuthNone("")
+		return
+	}
+
+	parser := reflect.ValueOf(authParser{})
+	zeroMethod := reflect.Value{}
+
+	arr := strings.Split(val, "://")
+	if len(arr) != 2 {
+		Fatal("authBackend has no scheme specified:", val)
+	}
+	scheme := arr[0]
+
+	methodName := "Auth" + strings.ToUpper(scheme[0:1]) + scheme[1:]
+	method := parser.MethodByName(methodName)
+	if method == zeroMethod {
+		Fatalf("no such authBackend \"%s\"\n", scheme)
+	}
+	args := []reflect.Value{reflect.ValueOf(arr[1])}
+	method.Call(args)
 }
 
 func (p configParser) ParseAllowedClient(val string) {
@@ -573,6 +697,11 @@ func (p configParser) ParseKey(val string) {
 // overrideConfig should contain options from command line to override options
 // in config file.
 func parseConfig(rc string, override *Config) {
+	// Parsing sets this back to true for any legacy option it sees; reset it
+	// here so a reload of an already-upgraded rc file doesn't upgrade again
+	// on every SIGHUP/admin reload, clobbering the previous "rc0.8" backup.
+	configNeedUpgrade = false
+
 	// fmt.Println("rcFile:", path)
 	f, err := os.Open(expandTilde(rc))
 	if err != nil {
@@ -626,6 +755,13 @@ func parseConfig(rc string, override *Config) {
 	if configNeedUpgrade {
 		upgradeConfig(rc, lines)
 	}
+
+	// upgradeConfig above expects parentProxy to still be the plain
+	// *backupParentPool built while parsing "proxy =" lines, so the
+	// loadBalance = latency swap must happen after it has run.
+	if config.LoadBalance == loadBalanceLatency {
+		parentProxy = buildLatencyParentPool(parentProxy)
+	}
 }
 
 func upgradeConfig(rc string, lines []string) {
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ewmaAlpha weights how quickly probe RTTs move the running average; higher
+// favors recent probes over history.
+const ewmaAlpha = 0.3
+
+// latencyTiebreakEpsilon is the probability of picking a random healthy
+// parent instead of the lowest-EWMA one, so a single fast parent doesn't
+// pin all traffic and starve the others' RTT samples.
+const latencyTiebreakEpsilon = 0.1
+
+// parentHealth tracks the probed health of a single parent: a running EWMA
+// of RTT, a consecutive-failure count and the backed-off time of the next
+// probe.
+type parentHealth struct {
+	parent ParentWithServer
+
+	mu          sync.RWMutex
+	ewmaRTT     time.Duration
+	failures    int
+	down        bool
+	nextProbeAt time.Time
+}
+
+// ParentWithServer is implemented by parent proxies that can be health
+// probed, i.e. those that expose the server address to dial.
+type ParentWithServer interface {
+	getServer() string
+	genConfig() string
+}
+
+// latencyParentPool selects the parent with the lowest EWMA RTT among
+// those currently marked healthy, implementing the loadBalanceLatency mode.
+type latencyParentPool struct {
+	parent []*parentHealth
+	stopCh chan struct{}
+}
+
+func newLatencyParentPool() *latencyParentPool {
+	return &latencyParentPool{stopCh: make(chan struct{})}
+}
+
+// stop terminates every probeLoop goroutine spawned by add, so a discarded
+// latencyParentPool (e.g. the one a config reload just replaced) doesn't
+// keep probing parents that are no longer in use.
+func (lp *latencyParentPool) stop() {
+	close(lp.stopCh)
+}
+
+// buildLatencyParentPool converts pool into a *latencyParentPool, carrying
+// over every parent that was added to it while parsing "proxy =" lines.
+// parseConfig calls this once parsing finishes and loadBalance = latency,
+// so selectParent actually probes and picks by RTT instead of parentProxy
+// silently staying a *backupParentPool and behaving like round-robin.
+func buildLatencyParentPool(pool ParentPool) ParentPool {
+	backup, ok := pool.(*backupParentPool)
+	if !ok {
+		// already a latencyParentPool, e.g. on a config reload
+		return pool
+	}
+	lp := newLatencyParentPool()
+	for _, p := range backup.parent {
+		if ps, ok := p.(ParentWithServer); ok {
+			lp.add(ps)
+		}
+	}
+	return lp
+}
+
+func (lp *latencyParentPool) add(p ParentWithServer) {
+	ph := &parentHealth{parent: p}
+	lp.parent = append(lp.parent, ph)
+	go lp.probeLoop(ph)
+}
+
+// probeLoop periodically TCP-dials the parent address, updating its EWMA
+// RTT and failure count, and backs off exponentially while the parent is
+// down before re-probing. It returns as soon as lp.stop is called, so a
+// pool discarded on reload doesn't leak a goroutine per parent.
+func (lp *latencyParentPool) probeLoop(ph *parentHealth) {
+	for {
+		ph.mu.RLock()
+		wait := time.Until(ph.nextProbeAt)
+		ph.mu.RUnlock()
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-lp.stopCh:
+				return
+			}
+		}
+
+		select {
+		case <-lp.stopCh:
+			return
+		default:
+		}
+
+		rtt, err := probeParent(ph.parent.getServer())
+
+		ph.mu.Lock()
+		if err != nil {
+			ph.failures++
+			if ph.failures >= config.LatencyFailThreshold {
+				ph.down = true
+			}
+			ph.nextProbeAt = time.Now().Add(backoffDuration(config.LatencyProbeInterval, ph.failures))
+			metrics.recordParentDialError(ph.parent.genConfig())
+		} else {
+			ph.ewmaRTT = nextEWMA(ph.ewmaRTT, rtt)
+			ph.failures = 0
+			ph.down = false
+			ph.nextProbeAt = time.Now().Add(config.LatencyProbeInterval)
+			metrics.recordParentRTT(ph.parent.genConfig(), rtt.Seconds())
+		}
+		ph.mu.Unlock()
+	}
+}
+
+// nextEWMA folds sample into prev using ewmaAlpha, seeding the average with
+// the first sample instead of biasing it towards zero.
+func nextEWMA(prev, sample time.Duration) time.Duration {
+	if prev == 0 {
+		return sample
+	}
+	return time.Duration(ewmaAlpha*float64(sample) + (1-ewmaAlpha)*float64(prev))
+}
+
+// backoffDuration returns how long to wait before re-probing a parent that
+// has failed failures times in a row, doubling interval per failure up to
+// a cap of 64x so a long-dead parent isn't hammered.
+func backoffDuration(interval time.Duration, failures int) time.Duration {
+	return interval * time.Duration(1<<uint(min(failures, 6)))
+}
+
+func probeParent(server string) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", server, config.LatencyProbeTimeout)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
+
+// selectParent picks the healthy parent with the lowest EWMA RTT, with a small
+// probability of picking a random healthy parent instead so a single fast
+// parent doesn't get pinned and starve others of probe traffic.
+func (lp *latencyParentPool) selectParent() ParentWithServer {
+	healthy := make([]*parentHealth, 0, len(lp.parent))
+	for _, ph := range lp.parent {
+		ph.mu.RLock()
+		down := ph.down
+		ph.mu.RUnlock()
+		if !down {
+			healthy = append(healthy, ph)
+		}
+	}
+	if len(healthy) == 0 {
+		// everything is down, fall back to the first configured parent
+		if len(lp.parent) > 0 {
+			return lp.parent[0].parent
+		}
+		return nil
+	}
+
+	var picked *parentHealth
+	if rand.Float64() < latencyTiebreakEpsilon {
+		picked = healthy[rand.Intn(len(healthy))]
+	} else {
+		best := healthy[0]
+		best.mu.RLock()
+		bestRTT := best.ewmaRTT
+		best.mu.RUnlock()
+		for _, ph := range healthy[1:] {
+			ph.mu.RLock()
+			rtt := ph.ewmaRTT
+			ph.mu.RUnlock()
+			if rtt < bestRTT {
+				best, bestRTT = ph, rtt
+			}
+		}
+		picked = best
+	}
+
+	return picked.parent
+}
+
+// dial selects a parent by RTT and dials host through it, via dialParent so
+// the connection counts towards meow_parent_selected_total,
+// meow_parent_dial_errors_total and meow_bytes_total the same way every
+// other pool's dials do.
+func (lp *latencyParentPool) dial(host string) (net.Conn, error) {
+	p := lp.selectParent()
+	if p == nil {
+		return nil, errors.New("latencyParentPool: no parent configured")
+	}
+	return dialParent(p, "latency", host)
+}
+
+// rtts returns the current EWMA RTT of each probed parent, keyed by its
+// genConfig string, for display on the admin /status endpoint.
+func (lp *latencyParentPool) rtts() map[string]time.Duration {
+	out := make(map[string]time.Duration, len(lp.parent))
+	for _, ph := range lp.parent {
+		ph.mu.RLock()
+		out[ph.parent.genConfig()] = ph.ewmaRTT
+		ph.mu.RUnlock()
+	}
+	return out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
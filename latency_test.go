@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeParent struct{ server string }
+
+func (f fakeParent) getServer() string { return f.server }
+func (f fakeParent) genConfig() string { return "fake://" + f.server }
+
+func TestNextEWMASeedsFromFirstSample(t *testing.T) {
+	got := nextEWMA(0, 100*time.Millisecond)
+	if got != 100*time.Millisecond {
+		t.Errorf("nextEWMA(0, 100ms) = %v, want 100ms", got)
+	}
+}
+
+func TestNextEWMABlendsTowardsSample(t *testing.T) {
+	prev := 100 * time.Millisecond
+	sample := 200 * time.Millisecond
+	got := nextEWMA(prev, sample)
+	want := time.Duration(ewmaAlpha*float64(sample) + (1-ewmaAlpha)*float64(prev))
+	if got != want {
+		t.Errorf("nextEWMA(100ms, 200ms) = %v, want %v", got, want)
+	}
+	if got <= prev || got >= sample {
+		t.Errorf("nextEWMA(100ms, 200ms) = %v, want strictly between prev and sample", got)
+	}
+}
+
+func TestBackoffDurationDoublesAndCaps(t *testing.T) {
+	interval := time.Second
+	cases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, interval},
+		{1, 2 * interval},
+		{2, 4 * interval},
+		{6, 64 * interval},
+		{20, 64 * interval}, // capped
+	}
+	for _, c := range cases {
+		if got := backoffDuration(interval, c.failures); got != c.want {
+			t.Errorf("backoffDuration(1s, %d) = %v, want %v", c.failures, got, c.want)
+		}
+	}
+}
+
+func TestStopEndsProbeLoop(t *testing.T) {
+	oldTimeout, oldInterval := config.LatencyProbeTimeout, config.LatencyProbeInterval
+	defer func() {
+		config.LatencyProbeTimeout = oldTimeout
+		config.LatencyProbeInterval = oldInterval
+	}()
+	config.LatencyProbeTimeout = 50 * time.Millisecond
+	config.LatencyProbeInterval = time.Hour
+
+	lp := newLatencyParentPool()
+	ph := &parentHealth{parent: fakeParent{server: "127.0.0.1:1"}}
+	lp.parent = append(lp.parent, ph)
+	lp.stop()
+
+	done := make(chan struct{})
+	go func() {
+		lp.probeLoop(ph)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("probeLoop did not return after stop was called")
+	}
+}
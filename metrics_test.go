@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLabeledCountersSnapshot(t *testing.T) {
+	c := newLabeledCounters()
+	c.add("parent=\"a\"", 1)
+	c.add("parent=\"a\"", 2)
+	c.add("parent=\"b\"", 5)
+
+	snap := c.snapshot()
+	if snap["parent=\"a\""] != 3 {
+		t.Errorf("counter a = %d, want 3", snap["parent=\"a\""])
+	}
+	if snap["parent=\"b\""] != 5 {
+		t.Errorf("counter b = %d, want 5", snap["parent=\"b\""])
+	}
+}
+
+func TestWriteExpositionContainsAllMetrics(t *testing.T) {
+	m := newMetricsRegistry()
+	m.recordConnection("127.0.0.1:4411", "http")
+	m.activeConnDelta(1)
+	m.recordParentSelected("proxy1", "http")
+	m.recordParentDialError("proxy1")
+	m.recordParentRTT("proxy1", 0.042)
+	m.recordBytes("up", "proxy1", 1024)
+	m.recordDomainDecision("direct")
+
+	rec := httptest.NewRecorder()
+	m.writeExposition(rec)
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"meow_connections_total{listener=\"127.0.0.1:4411\",proto=\"http\"} 1",
+		"meow_active_connections 1",
+		"meow_parent_selected_total{parent=\"proxy1\",proto=\"http\"} 1",
+		"meow_parent_dial_errors_total{parent=\"proxy1\"} 1",
+		"meow_parent_rtt_seconds_sum{parent=\"proxy1\"}",
+		"meow_bytes_total{direction=\"up\",parent=\"proxy1\"} 1024",
+		"meow_domain_decisions_total{decision=\"direct\"} 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("exposition missing %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestAcceptConnRecordsConnectionAndActiveCount(t *testing.T) {
+	before := metrics.activeConnections
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn, err := acceptConn(server, "127.0.0.1:9999", "http")
+	if err != nil {
+		t.Fatalf("acceptConn: %v", err)
+	}
+	if metrics.activeConnections != before+1 {
+		t.Errorf("activeConnections = %d, want %d", metrics.activeConnections, before+1)
+	}
+
+	conn.Close()
+	if metrics.activeConnections != before {
+		t.Errorf("activeConnections after close = %d, want %d", metrics.activeConnections, before)
+	}
+}
+
+// fakeDialParent is a ParentWithServer + parentDialer whose Dial returns one
+// end of a net.Pipe, so dialParent can be tested without a real network
+// round trip.
+type fakeDialParent struct {
+	fakeParent
+	conn net.Conn
+	err  error
+}
+
+func (f fakeDialParent) Dial(host string) (net.Conn, error) {
+	return f.conn, f.err
+}
+
+func TestDialParentRecordsSelectionAndRelayedBytes(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	p := fakeDialParent{fakeParent: fakeParent{server: "parent:443"}, conn: client}
+
+	before := metrics.bytesTotal.snapshot()["direction=\"up\",parent=\"fake://parent:443\""]
+	selKey := "parent=\"fake://parent:443\",proto=\"test\""
+	selBefore := metrics.parentSelectedTotal.snapshot()[selKey]
+
+	conn, err := dialParent(p, "test", "example.com:443")
+	if err != nil {
+		t.Fatalf("dialParent: %v", err)
+	}
+	defer conn.Close()
+
+	if got := metrics.parentSelectedTotal.snapshot()[selKey]; got != selBefore+1 {
+		t.Errorf("parentSelectedTotal = %d, want %d", got, selBefore+1)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 4)
+		server.Read(buf)
+		close(done)
+	}()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	<-done
+
+	after := metrics.bytesTotal.snapshot()["direction=\"up\",parent=\"fake://parent:443\""]
+	if after != before+4 {
+		t.Errorf("bytesTotal up = %d, want %d", after, before+4)
+	}
+}
+
+func TestDialParentRejectsNonDialer(t *testing.T) {
+	p := fakeParent{server: "parent:443"}
+	if _, err := dialParent(p, "test", "example.com:443"); err == nil {
+		t.Error("expected error dialing a parent that doesn't implement parentDialer")
+	}
+}
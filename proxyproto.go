@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// proxyProtoV2Sig is the 12 byte signature that starts every PROXY protocol
+// v2 header.
+var proxyProtoV2Sig = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyProtocolMode maps a listen address to the proxyProtocol mode
+// ("v1"/"v2") registered for it by listenParser.ListenHttp. The mode is
+// always required once set: a listener behind a fronting balancer should
+// never fall back to trusting the balancer's own address as the client's.
+//
+// registerProxyProtocol is called while parsing listeners, which can happen
+// again on a SIGHUP/admin reload while acceptConn is reading the map for
+// live connections, so both sides go through proxyProtocolModeMu.
+var (
+	proxyProtocolModeMu sync.RWMutex
+	proxyProtocolMode   = map[string]string{}
+)
+
+// registerProxyProtocol records that addr expects a PROXY protocol header
+// of the given mode on every accepted connection.
+func registerProxyProtocol(addr, mode string) {
+	proxyProtocolModeMu.Lock()
+	defer proxyProtocolModeMu.Unlock()
+	proxyProtocolMode[addr] = mode
+}
+
+// proxyProtocolModeFor returns the registered PROXY protocol mode for addr,
+// if any.
+func proxyProtocolModeFor(addr string) (string, bool) {
+	proxyProtocolModeMu.RLock()
+	defer proxyProtocolModeMu.RUnlock()
+	mode, ok := proxyProtocolMode[addr]
+	return mode, ok
+}
+
+// acceptConn should be called with every net.Conn returned by a listener's
+// Accept, right after accept, passing the address it was listening on and
+// the listener's protocol (e.g. "http"). It records meow_connections_total
+// and meow_active_connections, and if listenAddr was configured with
+// proxyProtocol=v1|v2, decodes the header so the returned conn's
+// RemoteAddr is the real client address, letting AllowedClient matching,
+// per-user rate limiting and logging all see through the fronting load
+// balancer.
+func acceptConn(conn net.Conn, listenAddr, proto string) (net.Conn, error) {
+	metrics.recordConnection(listenAddr, proto)
+	metrics.activeConnDelta(1)
+
+	mode, ok := proxyProtocolModeFor(listenAddr)
+	if !ok {
+		return &countingConn{Conn: conn}, nil
+	}
+
+	wrapped, err := wrapProxyProtocol(conn, mode, true)
+	if err != nil {
+		metrics.activeConnDelta(-1)
+		conn.Close()
+		return nil, err
+	}
+	return &countingConn{Conn: wrapped}, nil
+}
+
+// countingConn decrements meow_active_connections exactly once when the
+// connection is closed, however acceptConn's caller closes it.
+type countingConn struct {
+	net.Conn
+	closeOnce sync.Once
+}
+
+func (c *countingConn) Close() error {
+	c.closeOnce.Do(func() { metrics.activeConnDelta(-1) })
+	return c.Conn.Close()
+}
+
+var errProxyProtoMalformed = errors.New("proxy protocol: malformed or missing header")
+
+// proxyProtoConn wraps an accepted net.Conn whose true client address was
+// carried in a PROXY protocol header, so RemoteAddr reflects the original
+// client rather than the fronting load balancer.
+type proxyProtoConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// wrapProxyProtocol decodes a PROXY protocol header (v1 or v2, as selected
+// by mode) off conn and returns a proxyProtoConn whose RemoteAddr is the
+// decoded client address. If required and the header is malformed or
+// absent, it returns an error and the caller should close the connection.
+func wrapProxyProtocol(conn net.Conn, mode string, required bool) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+
+	var addr net.Addr
+	var err error
+	switch mode {
+	case "v1":
+		addr, err = parseProxyProtoV1(r)
+	case "v2":
+		addr, err = parseProxyProtoV2(r)
+	default:
+		err = errProxyProtoMalformed
+	}
+
+	if err != nil {
+		if required {
+			return nil, err
+		}
+		return &proxyProtoConn{Conn: conn, r: r, remoteAddr: conn.RemoteAddr()}, nil
+	}
+	if addr == nil {
+		// well-formed header with no address to report, e.g. a v2 LOCAL
+		// command; keep the real conn.RemoteAddr() regardless of required.
+		return &proxyProtoConn{Conn: conn, r: r, remoteAddr: conn.RemoteAddr()}, nil
+	}
+	return &proxyProtoConn{Conn: conn, r: r, remoteAddr: addr}, nil
+}
+
+// parseProxyProtoV1 parses the text form: "PROXY TCP4 src dst srcport dstport\r\n".
+func parseProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, errProxyProtoMalformed
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	fields := strings.Fields(line)
+	if len(fields) != 6 || fields[0] != "PROXY" {
+		return nil, errProxyProtoMalformed
+	}
+	switch fields[1] {
+	case "TCP4", "TCP6":
+	default:
+		return nil, errProxyProtoMalformed
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	if srcIP == nil {
+		return nil, errProxyProtoMalformed
+	}
+	srcPort, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, errProxyProtoMalformed
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+// parseProxyProtoV2 parses the binary v2 header: 12 byte signature,
+// version/command byte, address family/transport byte, 2 byte big-endian
+// length, then the address block.
+func parseProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := readFull(r, header); err != nil {
+		return nil, errProxyProtoMalformed
+	}
+	if string(header[:12]) != string(proxyProtoV2Sig) {
+		return nil, errProxyProtoMalformed
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 0x2 {
+		return nil, errProxyProtoMalformed
+	}
+	famProto := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	body := make([]byte, length)
+	if _, err := readFull(r, body); err != nil {
+		return nil, errProxyProtoMalformed
+	}
+
+	// LOCAL command (e.g. the balancer's own health checks) carries no
+	// meaningful address. It's a well-formed header, not garbage, so
+	// return no error alongside the nil address and let the caller keep
+	// conn.RemoteAddr() even when the header is required.
+	if verCmd&0x0F == 0x0 {
+		return nil, nil
+	}
+
+	switch famProto >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errProxyProtoMalformed
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errProxyProtoMalformed
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, errProxyProtoMalformed
+	}
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
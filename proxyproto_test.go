@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseProxyProtoV1(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("PROXY TCP4 192.168.1.1 192.168.1.2 56324 443\r\nGET / HTTP/1.1\r\n"))
+	addr, err := parseProxyProtoV1(r)
+	if err != nil {
+		t.Fatalf("parseProxyProtoV1: %v", err)
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("addr type = %T, want *net.TCPAddr", addr)
+	}
+	if tcpAddr.IP.String() != "192.168.1.1" || tcpAddr.Port != 56324 {
+		t.Errorf("addr = %v, want 192.168.1.1:56324", tcpAddr)
+	}
+}
+
+func TestParseProxyProtoV1Malformed(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n"))
+	if _, err := parseProxyProtoV1(r); err == nil {
+		t.Error("expected error for non-PROXY line")
+	}
+}
+
+func buildV2Header(t *testing.T, cmd, famProto byte, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.Write(proxyProtoV2Sig)
+	buf.WriteByte(0x20 | cmd) // version 2, command
+	buf.WriteByte(famProto)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(body)))
+	buf.Write(length)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func TestParseProxyProtoV2IPv4(t *testing.T) {
+	body := []byte{192, 168, 1, 1, 10, 0, 0, 1, 0xDB, 0xFB, 0x01, 0xBB} // src, dst, srcport, dstport
+	header := buildV2Header(t, 0x1, 0x11, body) // PROXY command, AF_INET/STREAM
+	r := bufio.NewReader(bytes.NewBuffer(header))
+
+	addr, err := parseProxyProtoV2(r)
+	if err != nil {
+		t.Fatalf("parseProxyProtoV2: %v", err)
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("addr type = %T, want *net.TCPAddr", addr)
+	}
+	if tcpAddr.IP.String() != "192.168.1.1" || tcpAddr.Port != 56315 {
+		t.Errorf("addr = %v, want 192.168.1.1:56315", tcpAddr)
+	}
+}
+
+func TestParseProxyProtoV2Local(t *testing.T) {
+	header := buildV2Header(t, 0x0, 0x00, nil) // LOCAL command
+	r := bufio.NewReader(bytes.NewBuffer(header))
+
+	addr, err := parseProxyProtoV2(r)
+	if err != nil {
+		t.Fatalf("parseProxyProtoV2: unexpected error %v", err)
+	}
+	if addr != nil {
+		t.Errorf("addr = %v, want nil for LOCAL command", addr)
+	}
+}
+
+func TestParseProxyProtoV2BadSignature(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBuffer(make([]byte, 16)))
+	if _, err := parseProxyProtoV2(r); err == nil {
+		t.Error("expected error for bad signature")
+	}
+}
+
+func TestWrapProxyProtocolLocalKeepsRealAddrWhenRequired(t *testing.T) {
+	header := buildV2Header(t, 0x0, 0x00, nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write(header)
+	}()
+
+	wrapped, err := wrapProxyProtocol(server, "v2", true)
+	if err != nil {
+		t.Fatalf("wrapProxyProtocol: %v", err)
+	}
+	if wrapped.RemoteAddr() != server.RemoteAddr() {
+		t.Errorf("RemoteAddr() = %v, want the pipe's real remote addr", wrapped.RemoteAddr())
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestTrojanInitAuth(t *testing.T) {
+	tp := newTrojanParent("example.com:443")
+	tp.initAuth("hunter2")
+
+	sum := sha256.Sum224([]byte("hunter2"))
+	want := hex.EncodeToString(sum[:])
+	if tp.passwdHash != want {
+		t.Errorf("passwdHash = %q, want %q", tp.passwdHash, want)
+	}
+}
+
+func TestTrojanGetServer(t *testing.T) {
+	tp := newTrojanParent("example.com:443")
+	if got := tp.getServer(); got != "example.com:443" {
+		t.Errorf("getServer() = %q, want %q", got, "example.com:443")
+	}
+}
+
+func TestTrojanRequestHeaderDomain(t *testing.T) {
+	header, err := trojanRequestHeader("example.com:443")
+	if err != nil {
+		t.Fatalf("trojanRequestHeader: %v", err)
+	}
+	want := []byte{0x01, 0x03, byte(len("example.com"))}
+	want = append(want, "example.com"...)
+	want = append(want, 0x01, 0xBB) // port 443 = 0x01BB
+	if string(header) != string(want) {
+		t.Errorf("header = % x, want % x", header, want)
+	}
+}
+
+func TestTrojanRequestHeaderIPv4(t *testing.T) {
+	header, err := trojanRequestHeader("127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("trojanRequestHeader: %v", err)
+	}
+	want := []byte{0x01, 0x01, 127, 0, 0, 1, 0x00, 0x50}
+	if string(header) != string(want) {
+		t.Errorf("header = % x, want % x", header, want)
+	}
+}
+
+func TestTrojanRequestHeaderInvalidPort(t *testing.T) {
+	if _, err := trojanRequestHeader("example.com:notaport"); err == nil {
+		t.Error("expected error for invalid port")
+	}
+}